@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// How many resource records to pack into each AXFR/IXFR response message
+// before starting a new one, keeping individual TCP messages a
+// reasonable size even for very large zones
+const axfrRecordsPerMessage = 100
+
+// typeIXFR is the IXFR query type (RFC 1995), not provided as a named
+// constant by golang.org/x/net/dns/dnsmessage
+const typeIXFR dnsmessage.Type = 251
+
+// isZoneTransferQuery reports whether buf is an AXFR or IXFR query,
+// without consuming it, so the TCP accept loop can route it to
+// handleZoneTransfer instead of the normal resolve-and-respond path
+func isZoneTransferQuery(buf []byte) bool {
+	var p dnsmessage.Parser
+	if _, err := p.Start(buf); err != nil {
+		return false
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return false
+	}
+
+	return question.Type == dnsmessage.TypeAXFR || question.Type == typeIXFR
+}
+
+// handleZoneTransfer streams a full zone transfer to a TCP client: the
+// SOA, every other record in the zone, then the SOA again, per RFC 5936.
+// IXFR requests are answered the same way, which is always a valid IXFR
+// response (a full zone reload) even though it isn't an incremental one.
+func handleZoneTransfer(conn net.Conn, queryBuf []byte) error {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(queryBuf)
+	if err != nil {
+		return err
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return err
+	}
+
+	z := findZone(question.Name.String())
+	if z == nil || !strings.EqualFold(z.origin, question.Name.String()) {
+		return sendZoneTransferError(conn, header.ID, question, dnsmessage.RCodeRefused)
+	}
+
+	records := append([]dnsmessage.Resource{z.soa}, z.allRecords()...)
+	records = append(records, z.soa)
+
+	for i := 0; i < len(records); i += axfrRecordsPerMessage {
+		end := i + axfrRecordsPerMessage
+		if end > len(records) {
+			end = len(records)
+		}
+
+		message := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true},
+			Questions: []dnsmessage.Question{question},
+			Answers:   records[i:end],
+		}
+
+		packed, err := message.Pack()
+		if err != nil {
+			return err
+		}
+		if err := writeTCPMessage(conn, packed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendZoneTransferError replies with a single message carrying the given
+// RCode, used when the client asks to transfer a zone we don't serve
+func sendZoneTransferError(conn net.Conn, id uint16, question dnsmessage.Question, rcode dnsmessage.RCode) error {
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, RCode: rcode},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	packed, err := message.Pack()
+	if err != nil {
+		return err
+	}
+	return writeTCPMessage(conn, packed)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Default maximum number of entries kept in the resolver cache before old
+// entries start getting dropped to make room for new ones, used unless
+// overridden by the -cache-size flag
+const defaultCacheMaxEntries = 50000
+
+// Negative cache entries (NXDOMAIN / NODATA) are capped at this TTL even
+// if the SOA MINIMUM from the authority section asks for longer, per the
+// guidance in RFC 2308, used unless overridden by the -neg-cache-ttl flag
+const defaultNegativeCacheTTL = time.Hour
+
+// negativeCacheTTLCap is the actual cap setNegative applies, settable via
+// configureCache
+var negativeCacheTTLCap = defaultNegativeCacheTTL
+
+// How often the cache sweeper wakes up to drop expired entries and
+// dangling CNAMEs
+const cacheSweepInterval = 30 * time.Second
+
+// cacheKey identifies a cached RRset by owner name, type and class
+type cacheKey struct {
+	Name  string
+	Type  dnsmessage.Type
+	Class dnsmessage.Class
+}
+
+// cacheEntry is either a positive RRset or a cached negative
+// (NXDOMAIN/NODATA) response, together with the time it expires
+type cacheEntry struct {
+	Resources []dnsmessage.Resource
+	RCode     dnsmessage.RCode
+	Negative  bool
+	Expires   time.Time
+}
+
+// resolverCache is a concurrency-safe cache of resolved DNS records keyed
+// by (name, type, class), including negative responses as described in
+// RFC 2308
+type resolverCache struct {
+	mu         sync.RWMutex
+	entries    map[cacheKey]cacheEntry
+	maxEntries int
+}
+
+// newResolverCache creates a resolver cache with the given entry limit and
+// starts the background sweeper that expires stale entries
+func newResolverCache(maxEntries int) *resolverCache {
+	c := &resolverCache{
+		entries:    make(map[cacheKey]cacheEntry),
+		maxEntries: maxEntries,
+	}
+	go c.sweepLoop()
+	return c
+}
+
+// cache is the single resolver cache shared by every incoming query,
+// sized by configureCache once flags have been parsed
+var cache *resolverCache
+
+// configureCache sizes the shared cache and sets the negative-cache TTL
+// cap, called once from main at startup once flags have been parsed
+func configureCache(maxEntries int, negativeTTLCap time.Duration) {
+	if maxEntries <= 0 {
+		fmt.Printf("Warning: -cache-size must be positive, using default of %d\n", defaultCacheMaxEntries)
+		maxEntries = defaultCacheMaxEntries
+	}
+	cache = newResolverCache(maxEntries)
+	negativeCacheTTLCap = negativeTTLCap
+}
+
+// get returns the cached entry for key if present and not yet expired
+func (c *resolverCache) get(key cacheKey) (cacheEntry, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if !ok || time.Now().After(entry.Expires) {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// setPositive caches a resolved RRset, expiring it after the minimum TTL
+// across the RRset as required by RFC 1035 section 4.1.2
+func (c *resolverCache) setPositive(key cacheKey, resources []dnsmessage.Resource) {
+	ttl := minTTL(resources)
+	if ttl == 0 {
+		return
+	}
+	c.store(key, cacheEntry{
+		Resources: resources,
+		Expires:   time.Now().Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// setNegative caches an NXDOMAIN or NODATA response, using the SOA
+// MINIMUM (capped by negativeCacheTTLCap) as the negative TTL per RFC 2308
+func (c *resolverCache) setNegative(key cacheKey, rcode dnsmessage.RCode, soaMinTTL uint32) {
+	ttl := time.Duration(soaMinTTL) * time.Second
+	if ttl > negativeCacheTTLCap {
+		ttl = negativeCacheTTLCap
+	}
+	c.store(key, cacheEntry{
+		RCode:    rcode,
+		Negative: true,
+		Expires:  time.Now().Add(ttl),
+	})
+}
+
+// store inserts or overwrites an entry, dropping an arbitrary existing
+// entry first if the cache is already at its size limit
+func (c *resolverCache) store(key cacheKey, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+// sweepLoop periodically removes expired entries and CNAMEs whose target
+// has fallen out of the cache
+func (c *resolverCache) sweepLoop() {
+	ticker := time.NewTicker(cacheSweepInterval)
+	for range ticker.C {
+		c.sweep()
+	}
+}
+
+// sweep drops expired entries and dangling CNAMEs
+func (c *resolverCache) sweep() {
+	now := time.Now()
+
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if now.After(entry.Expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+
+	c.evictDanglingCNAMEs()
+}
+
+// evictDanglingCNAMEs drops cached CNAME records whose target name has no
+// corresponding cache entry of its own, mirroring the dangling-CNAME
+// cleanup done by Go's net stack resolver cache
+func (c *resolverCache) evictDanglingCNAMEs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if key.Type != dnsmessage.TypeCNAME || entry.Negative {
+			continue
+		}
+
+		for _, resource := range entry.Resources {
+			cname, ok := resource.Body.(*dnsmessage.CNAMEResource)
+			if !ok {
+				continue
+			}
+
+			if !c.hasAnyType(cname.CNAME.String(), key.Class) {
+				delete(c.entries, key)
+			}
+		}
+	}
+}
+
+// hasAnyType reports whether the cache (without locking) holds any entry
+// at all for the given name and class, used to detect dangling CNAMEs
+func (c *resolverCache) hasAnyType(name string, class dnsmessage.Class) bool {
+	for key := range c.entries {
+		if key.Name == name && key.Class == class {
+			return true
+		}
+	}
+	return false
+}
+
+// minTTL returns the smallest TTL across a set of resource records, used
+// as the expiration for a cached RRset
+func minTTL(resources []dnsmessage.Resource) uint32 {
+	if len(resources) == 0 {
+		return 0
+	}
+
+	min := resources[0].Header.TTL
+	for _, resource := range resources[1:] {
+		if resource.Header.TTL < min {
+			min = resource.Header.TTL
+		}
+	}
+	return min
+}
+
+// closestKnownServers walks up from the queried name looking for a cached
+// delegation (NS records plus glue) so dnsQuery can start closer to the
+// authoritative zone instead of always iterating from the root servers
+func closestKnownServers(name dnsmessage.Name) []net.IP {
+	labels := strings.Split(strings.TrimSuffix(name.String(), "."), ".")
+
+	for i := 0; i < len(labels); i++ {
+		zone := strings.Join(labels[i:], ".") + "."
+
+		entry, ok := cache.get(cacheKey{Name: zone, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET})
+		if !ok || entry.Negative {
+			continue
+		}
+
+		if servers := glueForNameservers(entry.Resources); len(servers) > 0 {
+			return servers
+		}
+	}
+
+	return getRootServers()
+}
+
+// glueForNameservers resolves a set of cached NS records to their cached
+// A/AAAA glue addresses, if any are known
+func glueForNameservers(nsRecords []dnsmessage.Resource) []net.IP {
+	var servers []net.IP
+
+	for _, ns := range nsRecords {
+		nsResource, ok := ns.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+
+		for _, glueType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			entry, ok := cache.get(cacheKey{Name: nsResource.NS.String(), Type: glueType, Class: dnsmessage.ClassINET})
+			if !ok || entry.Negative {
+				continue
+			}
+
+			for _, glue := range entry.Resources {
+				switch body := glue.Body.(type) {
+				case *dnsmessage.AResource:
+					servers = append(servers, net.IP(body.A[:]))
+				case *dnsmessage.AAAAResource:
+					servers = append(servers, net.IP(body.AAAA[:]))
+				}
+			}
+		}
+	}
+
+	return servers
+}
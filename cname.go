@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Maximum number of CNAMEs to follow for a single question before giving
+// up, guarding against CNAME loops
+const maxCNAMEChainLength = 8
+
+// followCNAMEChain fills in the final answer for a question when the
+// authoritative answer set contains a CNAME but no record of the
+// requested type: it resolves the CNAME target (and any further CNAMEs
+// it points to, up to maxCNAMEChainLength) and appends the results to
+// the answer set
+func followCNAMEChain(question dnsmessage.Question, answers []dnsmessage.Resource) ([]dnsmessage.Resource, error) {
+	seen := map[string]bool{question.Name.String(): true}
+	cname := findCNAME(answers)
+
+	for i := 0; cname != nil && !hasType(answers, question.Type); i++ {
+		if i == maxCNAMEChainLength {
+			return nil, fmt.Errorf("CNAME chain for %s exceeded %d hops", question.Name.String(), maxCNAMEChainLength)
+		}
+
+		target := cname.CNAME.String()
+		if seen[target] {
+			return nil, fmt.Errorf("CNAME loop detected resolving %s at %s", question.Name.String(), target)
+		}
+		seen[target] = true
+
+		response, err := dnsQuery(closestKnownServers(cname.CNAME), dnsmessage.Question{
+			Name:  cname.CNAME,
+			Type:  question.Type,
+			Class: question.Class,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		answers = append(answers, response.Answers...)
+
+		// Advance to whatever CNAME (if any) the target we just resolved
+		// points to next, instead of re-scanning the whole accumulated
+		// answer set: a NODATA response (e.g. an AAAA query landing on an
+		// IPv4-only target) has no further CNAME to chase, and ends the
+		// chain here rather than being mistaken for a loop back to the
+		// original CNAME, which is still sitting in `answers`
+		cname = findCNAME(response.Answers)
+	}
+
+	return answers, nil
+}
+
+// hasType reports whether any resource in the set has the given type
+func hasType(resources []dnsmessage.Resource, t dnsmessage.Type) bool {
+	for _, resource := range resources {
+		if resource.Header.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// findCNAME returns the first CNAME resource in the set, if any
+func findCNAME(resources []dnsmessage.Resource) *dnsmessage.CNAMEResource {
+	for _, resource := range resources {
+		if cname, ok := resource.Body.(*dnsmessage.CNAMEResource); ok {
+			return cname
+		}
+	}
+	return nil
+}
@@ -1,12 +1,137 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 )
 
+// mode selects between the iterative recursive resolver and forwarding
+// every query to a fixed list of upstream resolvers
+var mode = flag.String("mode", "recursive", "resolution mode: recursive or forward")
+
+// cacheSize and negativeCacheTTL configure the shared resolver cache
+var cacheSize = flag.Int("cache-size", defaultCacheMaxEntries, "maximum number of entries kept in the resolver cache")
+var negativeCacheTTL = flag.Duration("neg-cache-ttl", defaultNegativeCacheTTL, "maximum TTL applied to negative (NXDOMAIN/NODATA) cache entries")
+
+// upstreamFlag collects the repeatable -upstream flag into a string slice
+type upstreamFlag []string
+
+func (u *upstreamFlag) String() string { return strings.Join(*u, ",") }
+
+func (u *upstreamFlag) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
+// upstreamAddresses holds the -upstream flag values used in forward mode,
+// e.g. -upstream=udp://1.1.1.1:53 -upstream=tls://1.1.1.1:853
+var upstreamAddresses upstreamFlag
+
+// defaultUpstreams is used in forward mode when no -upstream flag was given
+var defaultUpstreams = []string{"udp://1.1.1.1:53", "udp://8.8.8.8:53"}
+
+// zoneFlag collects the repeatable -zone flag into a string slice, each
+// entry in "name=/path/to/db.name" form
+type zoneFlag []string
+
+func (z *zoneFlag) String() string { return strings.Join(*z, ",") }
+
+func (z *zoneFlag) Set(value string) error {
+	*z = append(*z, value)
+	return nil
+}
+
+// zoneFlags holds the -zone flag values, e.g. -zone=example.com=/etc/dns/db.example.com
+var zoneFlags zoneFlag
+
+// notifyFlag collects the repeatable -notify flag into a string slice,
+// each entry in "name=secondary-ip" form
+type notifyFlag []string
+
+func (n *notifyFlag) String() string { return strings.Join(*n, ",") }
+
+func (n *notifyFlag) Set(value string) error {
+	*n = append(*n, value)
+	return nil
+}
+
+// notifyFlags holds the -notify flag values, e.g. -notify=example.com=192.0.2.53
+var notifyFlags notifyFlag
+
+func init() {
+	flag.Var(&upstreamAddresses, "upstream", "upstream resolver address (e.g. udp://1.1.1.1:53), may be repeated")
+	flag.Var(&zoneFlags, "zone", "zone this server is authoritative for, as name=/path/to/db.name, may be repeated")
+	flag.Var(&notifyFlags, "notify", "secondary to send a NOTIFY to on zone load, as name=secondary-ip, may be repeated")
+}
+
+// loadZoneFlags parses and registers every configured -zone flag
+func loadZoneFlags() error {
+	for _, entry := range zoneFlags {
+		name, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("malformed -zone flag %q, expected name=path", entry)
+		}
+		if err := registerZone(name, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendLoadNotifies sends a NOTIFY, per RFC 1996, to every secondary
+// configured via a -notify flag, once its zone has finished loading
+func sendLoadNotifies() error {
+	for _, entry := range notifyFlags {
+		name, secondaryAddr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("malformed -notify flag %q, expected name=secondary-ip", entry)
+		}
+
+		secondary := net.ParseIP(secondaryAddr)
+		if secondary == nil {
+			return fmt.Errorf("invalid -notify secondary address %q", secondaryAddr)
+		}
+
+		if err := notifySecondary(name, secondary); err != nil {
+			fmt.Printf("Warning: NOTIFY to %s for zone %s failed: %s\n", secondaryAddr, name, err)
+		}
+	}
+	return nil
+}
+
 func main() {
+	flag.Parse()
+
+	configureCache(*cacheSize, *negativeCacheTTL)
+
+	if err := loadZoneFlags(); err != nil {
+		panic(err)
+	}
+	if err := sendLoadNotifies(); err != nil {
+		panic(err)
+	}
+
+	if *mode == "forward" {
+		addresses := upstreamAddresses
+		if len(addresses) == 0 {
+			addresses = defaultUpstreams
+		}
+
+		upstreams := make([]Upstream, 0, len(addresses))
+		for _, address := range addresses {
+			upstream, err := NewUpstream(address)
+			if err != nil {
+				panic(err)
+			}
+			upstreams = append(upstreams, upstream)
+		}
+
+		configureResolver(*mode, upstreams)
+	}
+
 	fmt.Printf("Starting DNS Server...\n")
 	time.Sleep(1 * time.Second)
 	fmt.Printf("Meow\n")
@@ -20,6 +145,15 @@ func main() {
 	// Close packet connection when server is stopped
 	defer pc.Close()
 
+	// Listen on port 53 for TCP connections as well, for clients that
+	// retry over TCP after a truncated UDP response or that prefer TCP
+	// outright
+	go func() {
+		if err := startTCPServer(); err != nil {
+			panic(err)
+		}
+	}()
+
 	for {
 		// Create 512 byte buffer, write packet into it, origin address and packet size
 		buf := make([]byte, 512)
@@ -30,6 +164,6 @@ func main() {
 		}
 
 		// Resolve dns query from given packet in a goroutine
-		go HandlePacket(pc, addr, buf[:n])
+		go HandlePacket(udpResponder{pc: pc, addr: addr}, buf[:n])
 	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// notifyOpCode is the OPCODE used for the NOTIFY message defined in RFC 1996,
+// not provided as a named constant by golang.org/x/net/dns/dnsmessage
+const notifyOpCode = dnsmessage.OpCode(4)
+
+// notifySecondary sends a NOTIFY message for zoneName to a secondary
+// server, informing it that the zone may have changed and it should
+// consider an IXFR/AXFR, per RFC 1996
+func notifySecondary(zoneName string, secondary net.IP) error {
+	name, err := dnsmessage.NewName(zoneName)
+	if err != nil {
+		return err
+	}
+
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{OpCode: notifyOpCode, Authoritative: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	buf, err := message.Pack()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", secondary.String()+":53")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(buf)
+	return err
+}
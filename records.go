@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// glueIP extracts the IP address carried by an A or AAAA resource record,
+// returning nil for any other record type
+func glueIP(resource dnsmessage.Resource) net.IP {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:])
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:])
+	default:
+		return nil
+	}
+}
+
+// findSOA returns the first SOA record in resources, or nil if none is
+// present
+func findSOA(resources []dnsmessage.Resource) *dnsmessage.SOAResource {
+	for _, resource := range resources {
+		if soa, ok := resource.Body.(*dnsmessage.SOAResource); ok {
+			return soa
+		}
+	}
+	return nil
+}
@@ -13,6 +13,24 @@ import (
 
 const ROOT_SERVERS = "198.41.0.4,199.9.14.201,192.33.4.12,199.7.91.13,192.203.230.10,192.5.5.241,192.112.36.4,198.97.190.53"
 
+// UDP payload size we advertise via EDNS0 when querying other servers,
+// per RFC 6891. Large enough to avoid truncation for most answers; replies
+// this large exceed a typical 1500-byte MTU and arrive fragmented.
+const edns0UDPPayloadSize = 4096
+
+// buildOPTRecord constructs the pseudo-RR used to advertise an EDNS0 UDP
+// payload size, per RFC 6891 section 6.1
+func buildOPTRecord(udpPayloadSize uint16) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("."),
+			Type:  dnsmessage.TypeOPT,
+			Class: dnsmessage.Class(udpPayloadSize),
+		},
+		Body: &dnsmessage.OPTResource{},
+	}
+}
+
 // Read root servers from const string
 func getRootServers() []net.IP {
 	rootServers := []net.IP{}
@@ -35,14 +53,28 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 		return nil, nil, err
 	}
 
-	// Create dns message struct containing ID, response flag, opcode and questions
+	// 0x20-encode the question name's casing for extra query/response
+	// matching entropy, on top of the random ID and source port below
+	encodedName, err := encodeCase0x20(question.Name.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	sentQuestion := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(encodedName),
+		Type:  question.Type,
+		Class: question.Class,
+	}
+
+	// Create dns message struct containing ID, response flag, opcode, questions
+	// and an EDNS0 OPT record advertising how large a UDP reply we can accept
 	message := dnsmessage.Message{
 		Header: dnsmessage.Header{
 			ID:       uint16(randomNumber.Int64()),
 			Response: false,
 			OpCode:   dnsmessage.OpCode(0),
 		},
-		Questions: []dnsmessage.Question{question},
+		Questions:   []dnsmessage.Question{sentQuestion},
+		Additionals: []dnsmessage.Resource{buildOPTRecord(edns0UDPPayloadSize)},
 	}
 	// Write dns message into buffer
 	buf, err := message.Pack()
@@ -50,12 +82,12 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 		return nil, nil, err
 	}
 
-	// Try connection with any of the servers from list
+	// Try connection with any of the servers from list, each attempt from
+	// a freshly randomized source port rather than reusing the previous
+	// ephemeral port
 	var conn net.Conn
 	for _, server := range servers {
-
-		// Connect to server using dial with UDP on port 53
-		conn, err = net.Dial("udp", server.String()+":53")
+		conn, err = dialRandomSourcePort(server)
 
 		// Stop for loop if connection succeeded / no error
 		if err == nil {
@@ -67,6 +99,7 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 	if conn == nil {
 		return nil, nil, fmt.Errorf("Failed to make connection to servers: %s", err)
 	}
+	defer conn.Close()
 
 	// Write buffer into connection
 	_, err = conn.Write(buf)
@@ -74,8 +107,9 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 		return nil, nil, err
 	}
 
-	// Create new byte array buffer for answer
-	answer := make([]byte, 512)
+	// Create new byte array buffer for answer, sized to match the UDP
+	// payload size we just advertised via EDNS0
+	answer := make([]byte, edns0UDPPayloadSize)
 
 	// Read answer from connection into answer
 	n, err := bufio.NewReader(conn).Read(answer)
@@ -83,9 +117,6 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 		return nil, nil, err
 	}
 
-	// Close connection
-	conn.Close()
-
 	// Define parser
 	var p dnsmessage.Parser
 
@@ -97,10 +128,14 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 
 	// Parse questions from answer buffer
 	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Compare answer questions length to initial message questions length to check validity
-	if len(questions) != len(message.Questions) {
-		return nil, nil, fmt.Errorf("Answer package doesn't have the same amount of questions")
+	// Reject mismatched IDs, echoed questions or scrambled casing before
+	// trusting anything else in this response
+	if err := validateResponse(message.Header.ID, sentQuestion, headers, questions); err != nil {
+		return nil, nil, err
 	}
 
 	// Skip questions
@@ -109,14 +144,108 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 		return nil, nil, err
 	}
 
+	// A truncated UDP response means the answer didn't fit in the
+	// datagram; retry the exact same query over TCP to the server that
+	// actually answered, per RFC 1035 section 4.2.2
+	if headers.Truncated {
+		host, _, splitErr := net.SplitHostPort(conn.RemoteAddr().String())
+		if splitErr != nil {
+			host = conn.RemoteAddr().String()
+		}
+
+		return outgoingDnsQueryTCP(net.ParseIP(host), buf, message.Header.ID, sentQuestion)
+	}
+
 	// Return parser and headers
 	return &p, &headers, nil
 }
 
+// outgoingDnsQueryTCP sends an already-packed query to a single server over
+// TCP and parses its length-prefixed reply, used as the fallback for
+// truncated UDP answers
+func outgoingDnsQueryTCP(server net.IP, queryBuf []byte, requestID uint16, sentQuestion dnsmessage.Question) (*dnsmessage.Parser, *dnsmessage.Header, error) {
+	conn, err := net.Dial("tcp", server.String()+":53")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if err := writeTCPMessage(conn, queryBuf); err != nil {
+		return nil, nil, err
+	}
+
+	answer, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var p dnsmessage.Parser
+
+	headers, err := p.Start(answer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parser start error %s", err)
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateResponse(requestID, sentQuestion, headers, questions); err != nil {
+		return nil, nil, err
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, nil, err
+	}
+
+	return &p, &headers, nil
+}
+
+// resolverMode selects how incoming queries are resolved: "recursive"
+// iterates from the root (or the closest cached delegation) as before,
+// "forward" hands the query to a fixed list of configured upstreams
+var resolverMode = "recursive"
+
+// forwardUpstreams holds the resolvers to use when resolverMode is "forward"
+var forwardUpstreams []Upstream
+
+// configureResolver sets the resolution mode and, for forward mode, the
+// upstream resolvers to forward to. Called once from main at startup.
+func configureResolver(mode string, upstreams []Upstream) {
+	resolverMode = mode
+	forwardUpstreams = upstreams
+}
+
+// resolveQuestion answers a single question using whichever resolution
+// mode the server was started with
+func resolveQuestion(question dnsmessage.Question) (*dnsmessage.Message, error) {
+	if resolverMode == "forward" {
+		return forwardQuery(forwardUpstreams, question)
+	}
+
+	return dnsQuery(closestKnownServers(question.Name), question)
+}
+
 // Resolve a DNS query using given root servers
 func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Message, error) {
 	fmt.Printf("Question: %+v\n", question)
 
+	key := cacheKey{Name: question.Name.String(), Type: question.Type, Class: question.Class}
+
+	// Serve straight from cache if we already know the answer, positive or negative
+	if entry, ok := cache.get(key); ok {
+		if entry.Negative {
+			return &dnsmessage.Message{
+				Header: dnsmessage.Header{Response: true, RCode: entry.RCode},
+			}, nil
+		}
+
+		return &dnsmessage.Message{
+			Header:  dnsmessage.Header{Response: true},
+			Answers: entry.Resources,
+		}, nil
+	}
+
 	// Limt outgoing dns queries to 3 iterations
 	for i := 0; i < 3; i++ {
 
@@ -132,20 +261,62 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 			return nil, err
 		}
 
-		// If authoritative, return dns message with parsed answers
+		// Either way we'll need the authority section: an authoritative
+		// NXDOMAIN/NODATA answer carries its SOA there, and a referral
+		// carries the delegation's NS records there
+		authorities, err := dnsAnswer.AllAuthorities()
+		if err != nil {
+			return nil, err
+		}
+
+		// If authoritative, return dns message with parsed answers,
+		// following any CNAME chain until we have a record of the
+		// requested type (or run out of chain to follow)
 		if header.Authoritative {
+			if len(parsedAnswers) > 0 {
+				cache.setPositive(key, parsedAnswers)
+
+				answers, err := followCNAMEChain(question, parsedAnswers)
+				if err != nil {
+					return nil, err
+				}
+
+				return &dnsmessage.Message{
+					Header: dnsmessage.Header{
+						Response: true,
+					},
+					Answers: answers,
+				}, nil
+			}
+
+			// No matching RRset: this is an authoritative NXDOMAIN or
+			// NODATA. Negative-cache it using the SOA MINIMUM from the
+			// authority section, and propagate the server's RCode
+			// instead of silently reporting NoError either way.
+			if soa := findSOA(authorities); soa != nil {
+				cache.setNegative(key, header.RCode, soa.MinTTL)
+			}
+
 			return &dnsmessage.Message{
 				Header: dnsmessage.Header{
 					Response: true,
+					RCode:    header.RCode,
 				},
-				Answers: parsedAnswers,
 			}, nil
 		}
 
-		// If not authoritative, get all authorities
-		authorities, err := dnsAnswer.AllAuthorities()
-		if err != nil {
-			return nil, err
+		// Trust the referral only if it's delegating the name we actually
+		// asked about (or one of its parents); anything else can't
+		// legitimately speak for this query
+		zone := delegationZone(authorities, question.Name.String())
+
+		// Drop anything outside the bailiwick of the delegation zone
+		// before trusting it, classic protection against a malicious or
+		// compromised server injecting unrelated NS/glue records
+		if zone == "" {
+			authorities = nil
+		} else {
+			authorities = filterBailiwick(authorities, zone)
 		}
 
 		// If authorities empty, return dns name error message
@@ -157,6 +328,20 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 			}, nil
 		}
 
+		// If the in-bailiwick authority records of this referral include a
+		// SOA record, use its MINIMUM field and the server's RCode to
+		// negative-cache this query per RFC 2308, keeping NXDOMAIN and
+		// NODATA apart. A non-authoritative response whose authority
+		// section holds a SOA but no NS records never gets here: it has no
+		// delegation zone, so it is answered as a name error above and is
+		// not negative-cached.
+		for _, authority := range authorities {
+			if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+				cache.setNegative(key, header.RCode, soa.MinTTL)
+				break
+			}
+		}
+
 		// Define string array for nameservers
 		nameservers := make([]string, len(authorities))
 
@@ -172,6 +357,20 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 		if err != nil {
 			return nil, err
 		}
+		additionals = filterBailiwick(additionals, zone)
+
+		// Cache the delegation's NS + glue records, keyed by the zone
+		// being delegated rather than the leaf name we queried, so
+		// closestKnownServers's ancestor-zone walk can actually find it
+		// for sibling names under the same zone
+		delegationKey := cacheKey{Name: zone, Type: dnsmessage.TypeNS, Class: question.Class}
+		cache.setPositive(delegationKey, authorities)
+		for _, additional := range additionals {
+			if additional.Header.Type == dnsmessage.TypeA || additional.Header.Type == dnsmessage.TypeAAAA {
+				glueKey := cacheKey{Name: additional.Header.Name.String(), Type: additional.Header.Type, Class: additional.Header.Class}
+				cache.setPositive(glueKey, []dnsmessage.Resource{additional})
+			}
+		}
 
 		// Define newServersFound flag false
 		newServersFound := false
@@ -179,41 +378,46 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 		// Define array for server ip addresses
 		servers = []net.IP{}
 
-		// For each additional if A record check if nameservers are equal
-		// If true, set newServersFound flag true, add ip address to servers array
+		// For each additional if A/AAAA glue record matches a nameserver,
+		// set newServersFound flag true, add ip address to servers array
 		for _, additional := range additionals {
-			if additional.Header.Type == dnsmessage.TypeA {
-				for _, nameserver := range nameservers {
-					if additional.Header.Name.String() == nameserver {
-						newServersFound = true
-						servers = append(servers, additional.Body.(*dnsmessage.AResource).A[:])
-					}
+			ip := glueIP(additional)
+			if ip == nil {
+				continue
+			}
+			for _, nameserver := range nameservers {
+				if additional.Header.Name.String() == nameserver {
+					newServersFound = true
+					servers = append(servers, ip)
 				}
 			}
 		}
 
 		// If not authoritative and new servers found, iterate over nameservers
 		if !newServersFound {
-			// For each nameserver, if no new servers found, recursively call dnsQuery
-			// given new name and root servers
+			// For each nameserver, if no new servers found, recursively call
+			// dnsQuery for both its A and AAAA records so IPv6-only
+			// nameservers are usable too
 			for _, nameserver := range nameservers {
 				if !newServersFound {
-					response, err := dnsQuery(getRootServers(), dnsmessage.Question{
-						Name:  dnsmessage.MustNewName(nameserver),
-						Type:  dnsmessage.TypeA,
-						Class: dnsmessage.ClassINET,
-					})
-
-					// If error returned, log warning, else set newServersFound true
-					if err != nil {
-						fmt.Printf("Warning: Lookup of nameserver %s has failed: %err\n", nameserver, err)
-					} else {
-						newServersFound = true
-
-						// For each anser, read ip address from A record, add to servers array
+					for _, lookupType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+						response, err := dnsQuery(getRootServers(), dnsmessage.Question{
+							Name:  dnsmessage.MustNewName(nameserver),
+							Type:  lookupType,
+							Class: dnsmessage.ClassINET,
+						})
+
+						// If error returned, log warning, else set newServersFound
+						// true for each A/AAAA address found in the answers
+						if err != nil {
+							fmt.Printf("Warning: Lookup of nameserver %s has failed: %s\n", nameserver, err)
+							continue
+						}
+
 						for _, answer := range response.Answers {
-							if answer.Header.Type == dnsmessage.TypeA {
-								servers = append(servers, answer.Body.(*dnsmessage.AResource).A[:])
+							if ip := glueIP(answer); ip != nil {
+								newServersFound = true
+								servers = append(servers, ip)
 							}
 						}
 					}
@@ -231,7 +435,7 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 }
 
 // / Handle an incoming dns message packet
-func handlePacket(pc net.PacketConn, addr net.Addr, buf []byte) error {
+func handlePacket(resp responder, buf []byte) error {
 	// Define parser
 	p := dnsmessage.Parser{}
 
@@ -247,33 +451,97 @@ func handlePacket(pc net.PacketConn, addr net.Addr, buf []byte) error {
 		return err
 	}
 
-	// Resolve question using root servers
-	response, err := dnsQuery(getRootServers(), question)
-	if err != nil {
-		return err
+	// The client may have advertised its own UDP payload size via an
+	// EDNS0 OPT record; fall back to the classic 512 byte limit if it
+	// didn't, per RFC 6891
+	clientBufferSize, clientEDNS0 := parseClientUDPPayloadSize(&p)
+
+	// If the question falls within a zone we're configured to serve
+	// authoritatively, answer it from there instead of resolving it
+	var response *dnsmessage.Message
+	if z := findZone(question.Name.String()); z != nil {
+		response = z.answer(question)
+	} else {
+		// Resolve question, either recursively (starting from the closest
+		// cached delegation, falling back to the root servers) or by
+		// forwarding it to the configured upstreams, depending on -mode
+		response, err = resolveQuestion(question)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Set id of response packet
 	response.ID = header.ID
 
+	// Echo back an OPT record of our own whenever the client advertised
+	// EDNS0 support, so it can confirm we understood it, per RFC 6891
+	if clientEDNS0 {
+		response.Additionals = append(response.Additionals, buildOPTRecord(edns0UDPPayloadSize))
+	}
+
 	// Write response into response buffer
 	responseBuf, err := response.Pack()
 	if err != nil {
 		return err
 	}
 
-	// Write response to packet connection
-	_, err = pc.WriteTo(responseBuf, addr)
-	if err != nil {
-		return err
+	// If the client is UDP and our response is larger than the buffer
+	// size it advertised, truncate and let it retry over TCP instead of
+	// sending a datagram it can't use
+	if _, isUDP := resp.(udpResponder); isUDP && len(responseBuf) > int(clientBufferSize) {
+		response.Truncated = true
+		response.Answers = nil
+		response.Authorities = nil
+		response.Additionals = nil
+		if clientEDNS0 {
+			response.Additionals = []dnsmessage.Resource{buildOPTRecord(edns0UDPPayloadSize)}
+		}
+
+		responseBuf, err = response.Pack()
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	// Write response back to the client, over whichever transport the
+	// query arrived on
+	return resp.Respond(responseBuf)
 }
 
 // Public wrapper function to run handlePacket from goroutines
-func HandlePacket(pc net.PacketConn, addr net.Addr, buf []byte) {
-	if err := handlePacket(pc, addr, buf); err != nil {
-		fmt.Printf("Error while calling handlePacket [%s]: %s\n", addr.String(), err)
+func HandlePacket(resp responder, buf []byte) {
+	if err := handlePacket(resp, buf); err != nil {
+		fmt.Printf("Error while calling handlePacket: %s\n", err)
+	}
+}
+
+// parseClientUDPPayloadSize reads the UDP payload size and EDNS0 support
+// a client advertised via an OPT additional record, defaulting to the
+// classic 512 byte limit and no EDNS0 support when no OPT record is present
+func parseClientUDPPayloadSize(p *dnsmessage.Parser) (size uint16, edns0 bool) {
+	const classicUDPPayloadSize = 512
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return classicUDPPayloadSize, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return classicUDPPayloadSize, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return classicUDPPayloadSize, false
 	}
+
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return classicUDPPayloadSize, false
+	}
+
+	for _, additional := range additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			return uint16(additional.Header.Class), true
+		}
+	}
+
+	return classicUDPPayloadSize, false
 }
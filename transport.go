@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// responder abstracts writing a DNS response back to the client so the
+// same HandlePacket logic can serve both UDP datagrams and TCP streams
+type responder interface {
+	Respond(buf []byte) error
+}
+
+// udpResponder writes a response back to a UDP client via the shared
+// packet connection the query arrived on
+type udpResponder struct {
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func (r udpResponder) Respond(buf []byte) error {
+	_, err := r.pc.WriteTo(buf, r.addr)
+	return err
+}
+
+// tcpResponder writes a response back to a TCP client, length-prefixed as
+// required by RFC 1035 section 4.2.2
+type tcpResponder struct {
+	conn net.Conn
+}
+
+func (r tcpResponder) Respond(buf []byte) error {
+	return writeTCPMessage(r.conn, buf)
+}
+
+// writeTCPMessage writes a DNS message to a stream connection preceded by
+// its 2-byte big-endian length, per RFC 1035 section 4.2.2
+func writeTCPMessage(conn net.Conn, buf []byte) error {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(buf)))
+
+	if _, err := conn.Write(length); err != nil {
+		return err
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// readTCPMessage reads a single length-prefixed DNS message from a stream
+// connection
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// startTCPServer listens for TCP DNS queries on :53 and hands each
+// connection off to handleTCPConn, mirroring the UDP accept loop in main
+func startTCPServer() error {
+	listener, err := net.Listen("tcp", ":53")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("TCP accept error: %s\n", err)
+			continue
+		}
+
+		go handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn reads a single length-prefixed query from a TCP client
+// and resolves it through the same HandlePacket path used for UDP, except
+// for AXFR/IXFR zone transfers which get their own streaming response
+func handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	buf, err := readTCPMessage(conn)
+	if err != nil {
+		fmt.Printf("TCP read error from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	if isZoneTransferQuery(buf) {
+		if err := handleZoneTransfer(conn, buf); err != nil {
+			fmt.Printf("Zone transfer error for %s: %s\n", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	HandlePacket(tcpResponder{conn: conn}, buf)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// How long an upstream exchange may take before it's considered failed,
+// whichever protocol it uses
+const upstreamTimeout = 5 * time.Second
+
+// dnsMessageMIMEType is the content type DNS-over-HTTPS messages are sent
+// and received as, per RFC 8484 section 6
+const dnsMessageMIMEType = "application/dns-message"
+
+// Upstream resolves a single already-packed DNS query against one
+// configured resolver, abstracting over the wire protocol it speaks
+type Upstream interface {
+	Exchange(query []byte) ([]byte, error)
+	String() string
+}
+
+// NewUpstream parses an address such as "udp://1.1.1.1:53",
+// "tcp://1.1.1.1:53", "tls://1.1.1.1:853" (optionally pinned as
+// "tls://1.1.1.1:853#sha256-<base64 SPKI hash>") or
+// "https://dns.google/dns-query" into the matching Upstream
+// implementation, in the style of dnsproxy's AddressToUpstream
+func NewUpstream(address string) (Upstream, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream address %q: %s", address, err)
+	}
+
+	switch parsed.Scheme {
+	case "udp":
+		return &plainUpstream{network: "udp", addr: parsed.Host}, nil
+	case "tcp":
+		return &plainUpstream{network: "tcp", addr: parsed.Host}, nil
+	case "tls":
+		upstream := &dotUpstream{addr: parsed.Host}
+		if parsed.Fragment != "" {
+			pin, err := parseSPKIPin(parsed.Fragment)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream address %q: %s", address, err)
+			}
+			upstream.spkiPin = pin
+		}
+		return upstream, nil
+	case "https":
+		return &dohUpstream{endpoint: address}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q in %q", parsed.Scheme, address)
+	}
+}
+
+// parseSPKIPin decodes a "sha256-<base64>" fragment, as found on a pinned
+// tls:// upstream address, into the raw SPKI hash dotUpstream.verifyPin
+// compares against
+func parseSPKIPin(fragment string) ([]byte, error) {
+	const prefix = "sha256-"
+	if !strings.HasPrefix(fragment, prefix) {
+		return nil, fmt.Errorf("unsupported pin format %q, expected %q<base64 SPKI hash>", fragment, prefix)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimPrefix(fragment, prefix))
+}
+
+// plainUpstream speaks classic unencrypted DNS over UDP or TCP
+type plainUpstream struct {
+	network string
+	addr    string
+}
+
+func (u *plainUpstream) String() string { return u.network + "://" + u.addr }
+
+func (u *plainUpstream) Exchange(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(u.network, u.addr, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if u.network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	answer := make([]byte, edns0UDPPayloadSize)
+	n, err := conn.Read(answer)
+	if err != nil {
+		return nil, err
+	}
+	return answer[:n], nil
+}
+
+// dotUpstream speaks DNS-over-TLS (RFC 7858) over a TCP connection
+// wrapped in TLS, optionally pinning the server certificate by the
+// SHA-256 hash of its SubjectPublicKeyInfo
+type dotUpstream struct {
+	addr    string
+	spkiPin []byte
+}
+
+func (u *dotUpstream) String() string { return "tls://" + u.addr }
+
+func (u *dotUpstream) Exchange(query []byte) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: upstreamTimeout}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.addr, &tls.Config{
+		VerifyPeerCertificate: u.verifyPin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+// verifyPin checks the leaf certificate's SPKI hash against the pinned
+// value, when one was configured, alongside Go's normal chain validation
+func (u *dotUpstream) verifyPin(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(u.spkiPin) == 0 {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate presented by %s", u.addr)
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if !bytes.Equal(sum[:], u.spkiPin) {
+		return fmt.Errorf("SPKI pin mismatch for %s", u.addr)
+	}
+	return nil
+}
+
+// dohUpstream speaks DNS-over-HTTPS (RFC 8484) using the POST form, with
+// the query carried verbatim as the wire-format message body
+type dohUpstream struct {
+	endpoint string
+}
+
+func (u *dohUpstream) String() string { return u.endpoint }
+
+func (u *dohUpstream) Exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageMIMEType)
+	req.Header.Set("Accept", dnsMessageMIMEType)
+
+	client := http.Client{Timeout: upstreamTimeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s returned status %d", u.endpoint, resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// raceUpstreams sends the same query to every configured upstream in
+// parallel and returns whichever response comes back first without an
+// exchange error, falling over to the remaining upstreams if some of them
+// fail. The response itself is not validated here.
+func raceUpstreams(upstreams []Upstream, query []byte) ([]byte, error) {
+	type result struct {
+		answer []byte
+		err    error
+		from   Upstream
+	}
+
+	results := make(chan result, len(upstreams))
+	for _, upstream := range upstreams {
+		go func(u Upstream) {
+			answer, err := u.Exchange(query)
+			results <- result{answer: answer, err: err, from: u}
+		}(upstream)
+	}
+
+	var lastErr error
+	for i := 0; i < len(upstreams); i++ {
+		r := <-results
+		if r.err != nil {
+			fmt.Printf("Warning: upstream %s failed: %s\n", r.from.String(), r.err)
+			lastErr = r.err
+			continue
+		}
+		return r.answer, nil
+	}
+
+	return nil, fmt.Errorf("all upstreams failed, last error: %s", lastErr)
+}
+
+// forwardQuery resolves a question by handing it, as-is, to the
+// configured upstream resolvers instead of iterating from the root
+func forwardQuery(upstreams []Upstream, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	max := ^uint16(0)
+	randomNumber, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return nil, err
+	}
+
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(randomNumber.Int64()),
+			RecursionDesired: true,
+		},
+		Questions:   []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{buildOPTRecord(edns0UDPPayloadSize)},
+	}
+
+	buf, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := raceUpstreams(upstreams, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject a mismatched ID or echoed question before trusting this
+	// answer, the same spoofing check the recursive path applies to
+	// every response it receives
+	var p dnsmessage.Parser
+	answerHeader, err := p.Start(answer)
+	if err != nil {
+		return nil, fmt.Errorf("Parser start error %s", err)
+	}
+	answerQuestions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponse(message.Header.ID, question, answerHeader, answerQuestions); err != nil {
+		return nil, err
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(answer); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
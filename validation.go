@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Range of local UDP ports a random source port is picked from for each
+// outgoing query, instead of letting the single net.Dial call for the
+// whole resolution reuse whatever ephemeral port the OS handed out last
+const (
+	sourcePortRangeLow  = 1024
+	sourcePortRangeHigh = 65535
+)
+
+// dialRandomSourcePort opens a UDP socket bound to a randomly chosen
+// local port and connects it to server:53, retrying on a handful of
+// other random ports if the chosen one is already in use
+func dialRandomSourcePort(server net.IP) (net.Conn, error) {
+	const maxAttempts = 10
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		port, err := randomSourcePort()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := net.DialUDP("udp", &net.UDPAddr{Port: port}, &net.UDPAddr{IP: server, Port: 53})
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("failed to bind a random source port: %s", lastErr)
+}
+
+func randomSourcePort() (int, error) {
+	span := big.NewInt(int64(sourcePortRangeHigh - sourcePortRangeLow + 1))
+	n, err := rand.Int(rand.Reader, span)
+	if err != nil {
+		return 0, err
+	}
+	return sourcePortRangeLow + int(n.Int64()), nil
+}
+
+// encodeCase0x20 randomly flips the case of each letter in name. Sending
+// the query with this scrambled casing and checking that the response's
+// question section echoes it back exactly adds extra entropy an
+// off-path attacker has to guess, on top of the query ID and source port.
+func encodeCase0x20(name string) (string, error) {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 'a' || r > 'z' {
+			b.WriteRune(r)
+			continue
+		}
+
+		flip, err := rand.Int(rand.Reader, big.NewInt(2))
+		if err != nil {
+			return "", err
+		}
+		if flip.Int64() == 1 {
+			r -= 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// validateResponse rejects the classic off-path spoofing signatures: a
+// response ID that doesn't match the query, and an echoed question that
+// doesn't match what was sent (including its 0x20-encoded casing)
+func validateResponse(requestID uint16, sentQuestion dnsmessage.Question, header dnsmessage.Header, gotQuestions []dnsmessage.Question) error {
+	if header.ID != requestID {
+		return fmt.Errorf("response ID %d does not match request ID %d", header.ID, requestID)
+	}
+
+	if len(gotQuestions) != 1 {
+		return fmt.Errorf("expected 1 question in response, got %d", len(gotQuestions))
+	}
+
+	got := gotQuestions[0]
+	if got.Type != sentQuestion.Type || got.Class != sentQuestion.Class {
+		return fmt.Errorf("response question type/class does not match request")
+	}
+	if got.Name.String() != sentQuestion.Name.String() {
+		return fmt.Errorf("response question name %q does not match the request name %q", got.Name.String(), sentQuestion.Name.String())
+	}
+
+	return nil
+}
+
+// inBailiwick reports whether owner is zone itself or a subdomain of
+// zone, rejecting authority and additional records that have nothing to
+// do with the zone being resolved (the classic Kaminsky glue-injection
+// mitigation). Ancestors of zone are deliberately NOT accepted: a server
+// delegating zone has no authority to speak for its own parents.
+func inBailiwick(owner string, zone string) bool {
+	owner = strings.ToLower(strings.TrimSuffix(owner, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	if zone == "" {
+		return false
+	}
+	return owner == zone || strings.HasSuffix(owner, "."+zone)
+}
+
+// filterBailiwick drops any resource whose owner name fails the
+// in-bailiwick check against the zone being resolved
+func filterBailiwick(resources []dnsmessage.Resource, zone string) []dnsmessage.Resource {
+	filtered := make([]dnsmessage.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if inBailiwick(resource.Header.Name.String(), zone) {
+			filtered = append(filtered, resource)
+		} else {
+			fmt.Printf("Warning: dropping out-of-bailiwick record %s for zone %s\n", resource.Header.Name.String(), zone)
+		}
+	}
+	return filtered
+}
+
+// delegationZone returns the zone name a referral response is delegating,
+// taken from the owner of its NS records. It only trusts a candidate zone
+// that is the queried name itself or one of its parent domains -- a
+// server has no business delegating a name it wasn't asked about -- and
+// returns "" if no authority record passes that check, meaning the
+// referral can't be trusted at all.
+func delegationZone(authorities []dnsmessage.Resource, queriedName string) string {
+	for _, authority := range authorities {
+		if authority.Header.Type != dnsmessage.TypeNS {
+			continue
+		}
+		owner := authority.Header.Name.String()
+		if inBailiwick(queriedName, owner) {
+			return owner
+		}
+	}
+	return ""
+}
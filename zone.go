@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zone holds the records this server is authoritative for, loaded from an
+// RFC 1035 master file and organised by owner name for fast lookup
+type zone struct {
+	mu      sync.RWMutex
+	origin  string
+	soa     dnsmessage.Resource
+	records map[string][]dnsmessage.Resource
+}
+
+// zones is the set of zones this server answers authoritatively for,
+// keyed by lower-cased, fully-qualified zone name
+var zones = struct {
+	mu sync.RWMutex
+	m  map[string]*zone
+}{m: make(map[string]*zone)}
+
+// registerZone loads a zone file and adds it to the set of zones served
+// authoritatively, as configured via repeated -zone name=path flags
+func registerZone(name string, path string) error {
+	z, err := loadZoneFile(name, path)
+	if err != nil {
+		return err
+	}
+
+	zones.mu.Lock()
+	zones.m[z.origin] = z
+	zones.mu.Unlock()
+
+	return nil
+}
+
+// findZone returns the most specific locally-served zone that qname falls
+// under, or nil if none of our zones cover it
+func findZone(qname string) *zone {
+	qname = strings.ToLower(qname)
+
+	zones.mu.RLock()
+	defer zones.mu.RUnlock()
+
+	var best *zone
+	for origin, z := range zones.m {
+		if qname == origin || strings.HasSuffix(qname, "."+origin) {
+			if best == nil || len(origin) > len(best.origin) {
+				best = z
+			}
+		}
+	}
+	return best
+}
+
+// loadZoneFile parses a simplified RFC 1035 master file: one record per
+// line as "name ttl IN type rdata...", blank lines and ";" comments are
+// ignored, $ORIGIN sets the origin used to qualify relative names, and a
+// line whose owner field is left blank (indicated by leading whitespace)
+// repeats the previous record's owner
+func loadZoneFile(name string, path string) (*zone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	z := &zone{
+		origin:  strings.ToLower(strings.TrimSuffix(name, ".")) + ".",
+		records: make(map[string][]dnsmessage.Resource),
+	}
+
+	lastOwner := z.origin
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || strings.HasPrefix(trimmed, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "$ORIGIN") {
+			fields := strings.Fields(trimmed)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s: malformed $ORIGIN directive %q", path, trimmed)
+			}
+			z.origin = strings.ToLower(strings.TrimSuffix(fields[1], ".")) + "."
+			continue
+		}
+
+		fields := strings.Fields(trimmed)
+		ownerOmitted := len(raw) > 0 && (raw[0] == ' ' || raw[0] == '\t')
+
+		var owner string
+		if ownerOmitted {
+			owner = lastOwner
+		} else {
+			if len(fields) < 1 {
+				return nil, fmt.Errorf("%s: malformed zone line %q", path, trimmed)
+			}
+			owner = fields[0]
+			fields = fields[1:]
+		}
+
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s: malformed zone line %q", path, trimmed)
+		}
+
+		ttl, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid TTL in %q", path, trimmed)
+		}
+		// fields[1] is the class, always IN in practice
+		rrType := fields[2]
+		rdata := fields[3:]
+
+		ownerName, err := qualifyName(owner, z.origin)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		lastOwner = ownerName.String()
+
+		resource, err := buildZoneResource(ownerName, uint32(ttl), rrType, rdata, z.origin)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if resource.Header.Type == dnsmessage.TypeSOA {
+			z.soa = resource
+		}
+
+		key := strings.ToLower(ownerName.String())
+		z.records[key] = append(z.records[key], resource)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa.Header.Type != dnsmessage.TypeSOA {
+		return nil, fmt.Errorf("%s: zone %s has no SOA record", path, name)
+	}
+
+	return z, nil
+}
+
+// qualifyName appends the zone origin to a relative name, leaving
+// already-qualified (trailing dot) names and "@" (the origin itself) as is
+func qualifyName(name string, origin string) (dnsmessage.Name, error) {
+	if name == "@" {
+		return dnsmessage.NewName(origin)
+	}
+	if !strings.HasSuffix(name, ".") {
+		name = name + "." + origin
+	}
+	return dnsmessage.NewName(name)
+}
+
+// buildZoneResource constructs a single resource record from a zone file
+// line's already-split type and rdata fields
+func buildZoneResource(owner dnsmessage.Name, ttl uint32, rrType string, rdata []string, origin string) (dnsmessage.Resource, error) {
+	header := dnsmessage.ResourceHeader{Name: owner, Class: dnsmessage.ClassINET, TTL: ttl}
+
+	switch strings.ToUpper(rrType) {
+	case "SOA":
+		if len(rdata) != 7 {
+			return dnsmessage.Resource{}, fmt.Errorf("SOA record for %s needs 7 fields, got %d", owner, len(rdata))
+		}
+		ns, err := qualifyName(rdata[0], origin)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		mbox, err := qualifyName(rdata[1], origin)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		serial, refresh, retry, expire, minimum, err := parseSOATimers(rdata[2:])
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+
+		header.Type = dnsmessage.TypeSOA
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.SOAResource{
+			NS: ns, MBox: mbox, Serial: serial, Refresh: refresh, Retry: retry, Expire: expire, MinTTL: minimum,
+		}}, nil
+
+	case "NS":
+		target, err := qualifyName(rdata[0], origin)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		header.Type = dnsmessage.TypeNS
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.NSResource{NS: target}}, nil
+
+	case "A":
+		ip := net.ParseIP(rdata[0]).To4()
+		if ip == nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid A address %q for %s", rdata[0], owner)
+		}
+		var addr [4]byte
+		copy(addr[:], ip)
+		header.Type = dnsmessage.TypeA
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr}}, nil
+
+	case "AAAA":
+		ip := net.ParseIP(rdata[0]).To16()
+		if ip == nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid AAAA address %q for %s", rdata[0], owner)
+		}
+		var addr [16]byte
+		copy(addr[:], ip)
+		header.Type = dnsmessage.TypeAAAA
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr}}, nil
+
+	case "CNAME":
+		target, err := qualifyName(rdata[0], origin)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		header.Type = dnsmessage.TypeCNAME
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.CNAMEResource{CNAME: target}}, nil
+
+	case "MX":
+		if len(rdata) != 2 {
+			return dnsmessage.Resource{}, fmt.Errorf("MX record for %s needs preference and exchange, got %d fields", owner, len(rdata))
+		}
+		pref, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid MX preference %q for %s", rdata[0], owner)
+		}
+		target, err := qualifyName(rdata[1], origin)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		header.Type = dnsmessage.TypeMX
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.MXResource{Pref: uint16(pref), MX: target}}, nil
+
+	case "TXT":
+		header.Type = dnsmessage.TypeTXT
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.TXTResource{TXT: rdata}}, nil
+
+	case "SRV":
+		if len(rdata) != 4 {
+			return dnsmessage.Resource{}, fmt.Errorf("SRV record for %s needs priority, weight, port and target, got %d fields", owner, len(rdata))
+		}
+		priority, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid SRV priority %q for %s", rdata[0], owner)
+		}
+		weight, err := strconv.ParseUint(rdata[1], 10, 16)
+		if err != nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid SRV weight %q for %s", rdata[1], owner)
+		}
+		port, err := strconv.ParseUint(rdata[2], 10, 16)
+		if err != nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid SRV port %q for %s", rdata[2], owner)
+		}
+		target, err := qualifyName(rdata[3], origin)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		header.Type = dnsmessage.TypeSRV
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.SRVResource{
+			Priority: uint16(priority), Weight: uint16(weight), Port: uint16(port), Target: target,
+		}}, nil
+
+	default:
+		return dnsmessage.Resource{}, fmt.Errorf("unsupported record type %q for %s", rrType, owner)
+	}
+}
+
+// parseSOATimers parses the five uint32 SOA timer fields (serial,
+// refresh, retry, expire, minimum)
+func parseSOATimers(fields []string) (serial, refresh, retry, expire, minimum uint32, err error) {
+	values := make([]uint32, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return 0, 0, 0, 0, 0, fmt.Errorf("invalid SOA timer %q", field)
+		}
+		values[i] = uint32(v)
+	}
+	return values[0], values[1], values[2], values[3], values[4], nil
+}
+
+// lookup returns the zone's records of type qtype at qname, plus whether
+// the zone has any records at all at that owner (to distinguish
+// NXDOMAIN from NODATA)
+func (z *zone) lookup(qname string, qtype dnsmessage.Type) (matches []dnsmessage.Resource, ownerExists bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	all, ok := z.records[strings.ToLower(qname)]
+	if !ok {
+		return nil, false
+	}
+
+	for _, resource := range all {
+		if resource.Header.Type == qtype {
+			matches = append(matches, resource)
+		}
+	}
+	return matches, true
+}
+
+// answer builds an authoritative response for a question against this
+// zone, returning NODATA or NXDOMAIN with the zone's SOA in the authority
+// section when there's nothing to answer with, per RFC 2308
+func (z *zone) answer(question dnsmessage.Question) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+	}
+
+	matches, ownerExists := z.lookup(question.Name.String(), question.Type)
+	if len(matches) > 0 {
+		msg.Answers = matches
+		return msg
+	}
+
+	// No record of the requested type: if the owner has a CNAME instead,
+	// return it so the caller can chase it like any other CNAME answer
+	if cnames, _ := z.lookup(question.Name.String(), dnsmessage.TypeCNAME); len(cnames) > 0 {
+		msg.Answers = cnames
+		return msg
+	}
+
+	msg.Authorities = []dnsmessage.Resource{z.soa}
+	if !ownerExists {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	return msg
+}
+
+// allRecords returns every record in the zone except the SOA, in the
+// order needed to build an AXFR/IXFR stream (SOA ... records ... SOA)
+func (z *zone) allRecords() []dnsmessage.Resource {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var all []dnsmessage.Resource
+	for _, records := range z.records {
+		for _, record := range records {
+			if record.Header.Type != dnsmessage.TypeSOA {
+				all = append(all, record)
+			}
+		}
+	}
+	return all
+}